@@ -0,0 +1,22 @@
+// Command mortar is the Mortar operator CLI.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: mortar <command> [args]")
+		os.Exit(1)
+	}
+
+	switch os.Args[1] {
+	case "migrate":
+		runMigrateCommand(os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		os.Exit(1)
+	}
+}
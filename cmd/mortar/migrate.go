@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/database"
+)
+
+// runMigrateCommand implements `mortar migrate up|down|version|force N`.
+func runMigrateCommand(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configPath := fs.String("config", "mortar.yml", "path to the Mortar config file")
+	fs.Parse(args)
+
+	rest := fs.Args()
+	if len(rest) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: mortar migrate up|down|version|force N")
+		os.Exit(1)
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load config %s: %s\n", *configPath, err)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	switch rest[0] {
+	case "up":
+		err = database.RunMigrations(ctx, cfg)
+	case "down":
+		err = database.MigrateDown(ctx, cfg)
+	case "version":
+		var version uint
+		var dirty bool
+		if version, dirty, err = database.MigrateVersion(cfg); err == nil {
+			fmt.Printf("version %d (dirty=%v)\n", version, dirty)
+		}
+	case "force":
+		if len(rest) < 2 {
+			fmt.Fprintln(os.Stderr, "usage: mortar migrate force N")
+			os.Exit(1)
+		}
+		var v int
+		if v, err = strconv.Atoi(rest[1]); err == nil {
+			err = database.MigrateForce(cfg, v)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate subcommand %q\n", rest[0])
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate %s: %s\n", rest[0], err)
+		os.Exit(1)
+	}
+}
@@ -3,10 +3,12 @@ package database
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,6 +16,7 @@ import (
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/knakk/rdf"
 	"github.com/knakk/sparql"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/pierrec/lz4"
 	//"github.com/DataDog/zstd"
@@ -28,26 +31,50 @@ import (
 	"github.com/gtfierro/mortar2/internal/logging"
 )
 
-// TODO: updating Brick model should update types in the 'stream' table
-
-// Database defines the interface to the underlying data store
-type Database interface {
+// MetadataStore defines the Brick/SPARQL/triples half of Mortar's storage:
+// stream registration, metadata triples, and SPARQL evaluation. It is
+// implemented by TimescaleDatabase regardless of which TSStore a deployment
+// picks, since the metadata layer is what sites are actually reusing across
+// time-series engines.
+type MetadataStore interface {
 	Close()
 	RunAsTransaction(context.Context, func(txn pgx.Tx) error) error
 	RegisterStream(context.Context, Stream) error
-	InsertHistoricalData(ctx context.Context, ds Dataset) error
-	ReadDataChunk(context.Context, io.Writer, *Query) error
 	QuerySparqlWriter(context.Context, io.Writer, string, string) error
 	QuerySparql(context.Context, string, string) (*sparql.Results, error)
-	GetGraph(context.Context, *ModelRequest, io.Writer) error
+	GetGraph(context.Context, *ModelRequest, GraphFormat, io.Writer) error
 	Qualify(context.Context, []string) (map[string][]int, error)
 	AddTriples(context.Context, TripleDataset) error
 }
 
+// TSStore defines the time-series half of Mortar's storage: writing and
+// reading readings for already-registered streams. Sites that already run a
+// time-series engine other than Timescale can implement just this interface
+// and keep Mortar's Brick+SPARQL metadata layer (MetadataStore) unchanged.
+type TSStore interface {
+	InsertHistoricalData(ctx context.Context, ds Dataset) error
+	ReadDataChunk(context.Context, io.Writer, *Query) error
+}
+
+// Database defines the full interface to the underlying data store: the
+// metadata/SPARQL layer plus whichever time-series backend a deployment is
+// configured to use.
+type Database interface {
+	MetadataStore
+	TSStore
+}
+
 // TimescaleDatabase is an implementation of Database for TimescaleDB
 type TimescaleDatabase struct {
 	pool            *pgxpool.Pool
 	reasonerAddress string
+	// reasonerMode selects how SPARQL queries are evaluated: "external" (default)
+	// proxies to the HTTP reasoner at reasonerAddress, "embedded" evaluates
+	// directly against the triples table in Postgres. See embedded_sparql.go.
+	reasonerMode string
+	// classifier derives Brick classes/URIs for streams whose RegisterStream
+	// call didn't include one; nil disables classification. See stream_templates.go.
+	classifier *streamClassifier
 }
 
 // NewTimescaleInsecureDefaults creates a new TimescaleDatabase with the insecure default settings: (listening localhost:5434 with user/pass = mortarchangeme/mortarpasswordchangeme)
@@ -64,13 +91,34 @@ func NewTimescaleInsecureDefaults(ctx context.Context) (Database, error) {
 			Address: "localhost:3030",
 		},
 	}
-	return NewTimescaleFromConfig(ctx, cfg)
+	return NewFromConfig(ctx, cfg)
 }
 
-// NewTimescaleFromConfig creates a new TimescaleDatabase with the given configuration
-func NewTimescaleFromConfig(ctx context.Context, cfg *config.Config) (Database, error) {
-	var err error
+// NewFromConfig creates a new Database for the given configuration, dispatching
+// on cfg.Database.Driver to pick the TSStore implementation ("timescale", the
+// default, or "influx"). The MetadataStore (Brick/SPARQL/triples) is always
+// backed by Postgres/Timescale, so sites switching TSStore keep the same
+// metadata layer.
+func NewFromConfig(ctx context.Context, cfg *config.Config) (Database, error) {
+	driver := cfg.Database.Driver
+	if len(driver) == 0 {
+		driver = "timescale"
+	}
+	switch driver {
+	case "timescale":
+		return newTimescaleFromConfig(ctx, cfg)
+	case "influx":
+		return newInfluxDatabaseFromConfig(ctx, cfg)
+	default:
+		return nil, fmt.Errorf("Unknown Database.Driver %q: must be \"timescale\" or \"influx\"", driver)
+	}
+}
 
+// connectPostgres opens (and waits for) a pgxpool.Pool for the Postgres
+// instance backing Mortar's MetadataStore, shared by the Timescale TSStore
+// and any alternative TSStore (e.g. Influx) that still wants Postgres for
+// Brick/SPARQL metadata.
+func connectPostgres(ctx context.Context, cfg *config.Config) (*pgxpool.Pool, error) {
 	if err := checkConfig(cfg); err != nil {
 		return nil, fmt.Errorf("Invalid config to connect to database: %w", err)
 	}
@@ -98,9 +146,44 @@ func NewTimescaleFromConfig(ctx context.Context, cfg *config.Config) (Database,
 		}
 	}
 	log.Infof("Connected to postgres at %s", cfg.Database.Host)
+
+	if cfg.Database.AutoMigrate {
+		if err := RunMigrations(ctx, cfg); err != nil {
+			return nil, fmt.Errorf("Could not auto-migrate schema: %w", err)
+		}
+	}
+
+	return pool, nil
+}
+
+// newTimescaleFromConfig creates a new TimescaleDatabase with the given configuration
+func newTimescaleFromConfig(ctx context.Context, cfg *config.Config) (Database, error) {
+	log := logging.FromContext(ctx)
+
+	pool, err := connectPostgres(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	reasonerMode := cfg.Reasoner.Mode
+	if len(reasonerMode) == 0 {
+		reasonerMode = "external"
+	}
+	if reasonerMode != "external" && reasonerMode != "embedded" {
+		return nil, fmt.Errorf("Invalid Reasoner.Mode %q: must be \"external\" or \"embedded\"", reasonerMode)
+	}
+	log.Infof("Reasoner mode: %s", reasonerMode)
+
+	classifier, err := loadStreamClassifier(cfg.Classification.MappingFile)
+	if err != nil {
+		return nil, err
+	}
+
 	return &TimescaleDatabase{
 		pool:            pool,
 		reasonerAddress: cfg.Reasoner.Address,
+		reasonerMode:    reasonerMode,
+		classifier:      classifier,
 	}, nil
 }
 
@@ -152,6 +235,10 @@ func (db *TimescaleDatabase) RegisterStream(ctx context.Context, stream Stream)
 
 	var registered = false
 	err := db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		if err := db.classify(ctx, txn, &stream); err != nil {
+			return fmt.Errorf("Could not classify stream: %w", err)
+		}
+
 		var (
 			brickURI   *string
 			brickClass *string
@@ -300,13 +387,28 @@ func (db *TimescaleDatabase) InsertHistoricalData(ctx context.Context, ds Datase
 	return err
 }
 
-func (db *TimescaleDatabase) writeMetadataArrow(ctx context.Context, w io.Writer, q *Query) error {
-	// if a sparql query is provided, then execute it, join on 'streams' to get all of the ids
-	// implied by the query, and use those to determine the ids in the 'data' table
+// resolveQueryIds populates q.Ids from q.Sparql/q.Uris when the caller didn't
+// already supply ids directly, so every consumer of a Query (the HTTP and
+// Flight data paths, and writeMetadataArrow below) resolves the same way.
+func (db *TimescaleDatabase) resolveQueryIds(ctx context.Context, q *Query) error {
+	log := logging.FromContext(ctx)
 	var err error
 
-	if len(q.Sparql) > 0 {
-		fmt.Println("SPARQL", q.Sparql)
+	if len(q.Ids) > 0 {
+		return nil
+	}
+
+	if len(q.Sparql) > 0 && db.reasonerMode == "embedded" {
+		// the embedded reasoner keeps triples in the same database as streams,
+		// so we can resolve URIs to stream ids with a single join instead of
+		// a SPARQL round trip followed by a separate streams lookup.
+		ids, err := db.resolveSparqlStreamIds(ctx, "default", q.Sparql, q.Sources)
+		if err != nil {
+			return err
+		}
+		q.Ids = append(q.Ids, ids...)
+	} else if len(q.Sparql) > 0 {
+		log.Debugf("Resolving SPARQL query for ids: %s", q.Sparql)
 		// TODO: get all graphs
 		var uris []string
 		res, err := db.QuerySparql(ctx, "default", q.Sparql)
@@ -314,7 +416,6 @@ func (db *TimescaleDatabase) writeMetadataArrow(ctx context.Context, w io.Writer
 			return err
 		}
 
-		fmt.Println("results", len(res.Results.Bindings))
 		for _, row := range res.Results.Bindings {
 			for _, value := range row {
 				if value.Type == "uri" {
@@ -322,7 +423,7 @@ func (db *TimescaleDatabase) writeMetadataArrow(ctx context.Context, w io.Writer
 				}
 			}
 		}
-		fmt.Println("metadata uris", len(uris))
+		log.Debugf("Resolved %d URIs from SPARQL query", len(uris))
 		// get ids from the uris
 		var rows pgx.Rows
 		if len(q.Sources) > 0 {
@@ -359,7 +460,16 @@ func (db *TimescaleDatabase) writeMetadataArrow(ctx context.Context, w io.Writer
 		}
 	}
 
-	fmt.Println("metadata ids", len(q.Ids))
+	log.Debugf("Resolved %d stream ids", len(q.Ids))
+	return nil
+}
+
+// writeMetadataArrow resolves q's ids (see resolveQueryIds) and writes the
+// matching streams' metadata as a single Arrow IPC record batch.
+func (db *TimescaleDatabase) writeMetadataArrow(ctx context.Context, w io.Writer, q *Query) error {
+	if err := db.resolveQueryIds(ctx, q); err != nil {
+		return err
+	}
 
 	metadataFields := []arrow.Field{
 		{Name: "brick_class", Type: arrow.BinaryTypes.String, Nullable: true},
@@ -410,6 +520,10 @@ func (db *TimescaleDatabase) writeMetadataArrow(ctx context.Context, w io.Writer
 	return mdWriter.Close()
 }
 
+// ReadDataChunk is a thin HTTP adapter over the same record-batch streaming
+// the Flight service (flight.go) uses for DoGet: it LZ4-wraps the stream so
+// existing HTTP clients keep working while new clients can talk Flight
+// directly for backpressure and parallel endpoints.
 func (db *TimescaleDatabase) ReadDataChunk(ctx context.Context, httpw io.Writer, q *Query) error {
 	ctx, cancel := context.WithTimeout(ctx, config.DataReadTimeout)
 	defer cancel()
@@ -422,75 +536,7 @@ func (db *TimescaleDatabase) ReadDataChunk(ctx context.Context, httpw io.Writer,
 		return fmt.Errorf("Error processing metadata: %w", err)
 	}
 
-	fmt.Println("query ids", len(q.Ids))
-
-	// TODO: need to do a better job of streaming this data out
-
-	sch := arrow.NewSchema([]arrow.Field{
-		{Name: "time", Type: arrow.FixedWidthTypes.Timestamp_ns, Nullable: false},
-		{Name: "value", Type: arrow.PrimitiveTypes.Float64, Nullable: false},
-		{Name: "id", Type: arrow.BinaryTypes.String, Nullable: false},
-	}, nil)
-	bldr := array.NewRecordBuilder(memory.DefaultAllocator, sch)
-	defer bldr.Release()
-
-	rTimes := bldr.Field(0).(*array.TimestampBuilder)
-	rValues := bldr.Field(1).(*array.Float64Builder)
-	rNames := bldr.Field(2).(*array.StringBuilder)
-
-	arrowWriter := ipc.NewWriter(w, ipc.WithSchema(bldr.Schema()))
-
-	var (
-		rows pgx.Rows
-		err  error
-	)
-	// write aggregation query if Query contains it
-	if q.AggregationFunc != nil && q.AggregationWindow != nil {
-		sql := fmt.Sprintf(`SELECT time_bucket('%s', time) as time, %s, COALESCE(brick_uri, name)
-							FROM unified WHERE time>=$1 and time <=$2 and stream_id = ANY($3)
-							GROUP BY time, stream_id, brick_uri, name`, *q.AggregationWindow, q.AggregationFunc.toSQL("value"))
-		rows, err = db.pool.Query(ctx, sql, q.Start.Format(time.RFC3339), q.End.Format(time.RFC3339), q.Ids)
-	} else {
-		rows, err = db.pool.Query(ctx, `SELECT time, value, COALESCE(brick_uri, name)
-										FROM unified WHERE time>=$1 and time <=$2 and stream_id = ANY($3)`, q.Start.Format(time.RFC3339), q.End.Format(time.RFC3339), q.Ids)
-	}
-	defer rows.Close()
-
-	if err != nil {
-		return fmt.Errorf("Could not query %w", err)
-	}
-	for rows.Next() {
-		var (
-			t time.Time
-			v float64
-			s string
-		)
-		if err := rows.Scan(&t, &v, &s); err != nil {
-			return fmt.Errorf("Could not query %w", err)
-		}
-		rTimes.Append(arrow.Timestamp(t.UnixNano()))
-		rValues.Append(v)
-		rNames.Append(s)
-
-		// TODO: measure/estimate size
-		if rValues.Len() > 2000000 { // 2 million readings
-			rec := bldr.NewRecord()
-
-			if err := arrowWriter.Write(rec); err != nil {
-				return fmt.Errorf("Could not write record %w", err)
-			}
-			rec.Release()
-		}
-	}
-
-	rec := bldr.NewRecord()
-	defer rec.Release()
-
-	if err := arrowWriter.Write(rec); err != nil {
-		return fmt.Errorf("Could not write record %w", err)
-	}
-
-	return arrowWriter.Close()
+	return db.writeDataArrow(ctx, w, q, defaultTargetBatchBytes)
 }
 
 func (db *TimescaleDatabase) QuerySparqlWriter(ctx context.Context, w io.Writer, graph string, sparqlQuery string) error {
@@ -499,6 +545,15 @@ func (db *TimescaleDatabase) QuerySparqlWriter(ctx context.Context, w io.Writer,
 	if len(graph) == 0 {
 		graph = "default"
 	}
+
+	if db.reasonerMode == "embedded" {
+		res, err := db.querySparqlEmbedded(ctx, graph, sparqlQuery)
+		if err != nil {
+			return fmt.Errorf("Could not query: %w", err)
+		}
+		return json.NewEncoder(w).Encode(res)
+	}
+
 	query := bytes.NewBuffer([]byte(sparqlQuery))
 
 	queryURL := fmt.Sprintf("http://%s/query/%s", db.reasonerAddress, graph)
@@ -518,6 +573,11 @@ func (db *TimescaleDatabase) QuerySparql(ctx context.Context, graph string, quer
 	if len(graph) == 0 {
 		graph = "default"
 	}
+
+	if db.reasonerMode == "embedded" {
+		return db.querySparqlEmbedded(ctx, graph, queryString)
+	}
+
 	repo, err := sparql.NewRepo(fmt.Sprintf("http://%s/query/%s", db.reasonerAddress, graph))
 	if err != nil {
 		return nil, fmt.Errorf("Could not connect to SPARQL endpoint: %w", err)
@@ -563,6 +623,12 @@ func (db *TimescaleDatabase) AddTriples(ctx context.Context, ds TripleDataset) e
 			return fmt.Errorf("Cannot insert triples for source %s: %w (drop temp)", ds.GetSource(), err)
 		}
 
+		if db.reasonerMode == "embedded" {
+			if err := db.materializeInferred(ctx, txn, ds.GetSource()); err != nil {
+				return fmt.Errorf("Cannot insert triples for source %s: %w (materialize)", ds.GetSource(), err)
+			}
+		}
+
 		return nil
 	})
 	if err == nil {
@@ -588,76 +654,66 @@ func (db *TimescaleDatabase) graphs(ctx context.Context) ([]string, error) {
 	return graphs, nil
 }
 
+// Qualify evaluates each query in qualifyQueryList against every known
+// graph, using a small worker pool. It returns partial results
+// deterministically: if any query fails, the shared context is canceled so
+// the remaining workers stop promptly instead of draining the task queue,
+// and the counts gathered before the failure are returned alongside the error.
 func (db *TimescaleDatabase) Qualify(ctx context.Context, qualifyQueryList []string) (map[string][]int, error) {
 	log := logging.FromContext(ctx)
 
-	var querySiteCounts = make(map[string][]int)
+	var (
+		querySiteCounts = make(map[string][]int)
+		mu              sync.Mutex
+	)
 
 	graphs, err := db.graphs(ctx)
 	if err != nil {
 		return querySiteCounts, err
 	}
 
-	numJobs := len(qualifyQueryList) * len(graphs)
-	tasks := make(chan queryTask, numJobs)
-	results := make(chan queryResult, numJobs)
-	errors := make(chan error, numJobs)
-	done := make(chan struct{})
-	var wg sync.WaitGroup
-	numWorkers := 4
-	wg.Add(numWorkers)
+	tasks := make(chan queryTask, len(qualifyQueryList)*len(graphs))
+	for queryIdx := range qualifyQueryList {
+		for _, graph := range graphs {
+			tasks <- queryTask{graph: graph, queryIdx: queryIdx}
+		}
+	}
+	close(tasks)
+
+	g, gctx := errgroup.WithContext(ctx)
+	const numWorkers = 4
 	for i := 0; i < numWorkers; i++ {
-		wctx, _ := context.WithTimeout(ctx, config.DataReadTimeout)
 		wid := i
-		go func() {
+		g.Go(func() error {
 			for task := range tasks {
+				if err := gctx.Err(); err != nil {
+					return err
+				}
+				wctx, cancel := context.WithTimeout(gctx, config.DataReadTimeout)
 				queryString := qualifyQueryList[task.queryIdx]
 				log.Infof("Querying graph %s with query %s", task.graph, queryString)
 				res, err := db.QuerySparql(wctx, task.graph, queryString)
+				cancel()
 				if err != nil {
-					log.Errorf("Could not evaluate query %s: %w", queryString, err)
-					errors <- err
-					break
+					return fmt.Errorf("Could not evaluate query %s: %w", queryString, err)
 				}
-				results <- queryResult{
-					queryTask:    task,
-					numSolutions: len(res.Solutions()),
+
+				numSolutions := len(res.Solutions())
+				mu.Lock()
+				if _, ok := querySiteCounts[task.graph]; !ok {
+					querySiteCounts[task.graph] = make([]int, len(qualifyQueryList))
 				}
-				log.Infof("Worker %d: Graph %s, Query %d, # results %d", wid, task.graph, task.queryIdx, len(res.Solutions()))
+				querySiteCounts[task.graph][task.queryIdx] = numSolutions
+				mu.Unlock()
+				log.Infof("Worker %d: Graph %s, Query %d, # results %d", wid, task.graph, task.queryIdx, numSolutions)
 			}
-			wg.Done()
-		}()
+			return nil
+		})
 	}
 
-	for queryIdx := range qualifyQueryList {
-		for _, graph := range graphs {
-			tasks <- queryTask{
-				graph:    graph,
-				queryIdx: queryIdx,
-			}
-		}
-	}
-	close(tasks)
-
-	go func() {
-		wg.Wait()
-		close(results)
-		done <- struct{}{}
-	}()
-
-	for res := range results {
-		if _, ok := querySiteCounts[res.graph]; !ok {
-			querySiteCounts[res.graph] = make([]int, len(qualifyQueryList))
-		}
-		querySiteCounts[res.graph][res.queryIdx] = res.numSolutions
-	}
-	select {
-	case err := <-errors:
-		return querySiteCounts, err
-	case <-done:
-	}
+	err = g.Wait()
 	log.Infof("Qualify result: %+v", querySiteCounts)
-	return querySiteCounts, nil
+	return querySiteCounts, err
 }
 
 func (db *TimescaleDatabase) checkAuth(ctx context.Context, permission, source string) (bool, error) {
@@ -675,9 +731,26 @@ func (db *TimescaleDatabase) checkAuth(ctx context.Context, permission, source s
 	return numOk > 0, nil
 }
 
-// writes NTriples serialization to  the writer
-func (db *TimescaleDatabase) GetGraph(ctx context.Context, req *ModelRequest, w io.Writer) error {
+// GraphFormat selects the serialization GetGraph writes.
+type GraphFormat string
+
+// Supported GetGraph serializations. GraphFormatHDT is accepted but not yet
+// implemented; see GetGraph.
+const (
+	GraphFormatTurtle   GraphFormat = "turtle"
+	GraphFormatNTriples GraphFormat = "ntriples"
+	GraphFormatJSONLD   GraphFormat = "jsonld"
+	GraphFormatHDT      GraphFormat = "hdt"
+)
+
+// GetGraph writes the graph named by req.Graph, as of req.Timestamp, to w in
+// the requested format. Rows stream directly from Postgres into the encoder
+// one triple at a time (via an io.Pipe feeding an rdf.TripleDecoder), so
+// memory use stays bounded regardless of graph size.
+func (db *TimescaleDatabase) GetGraph(ctx context.Context, req *ModelRequest, format GraphFormat, w io.Writer) error {
 	log := logging.FromContext(ctx)
+	log.Infof("Get graph %+v (format %s)", req, format)
+
 	rows, err := db.pool.Query(ctx, `WITH latest AS (SELECT source, origin, MAX(time) as time
 													 FROM triples WHERE time <= $1 and source = $2
 													 GROUP BY source, origin)
@@ -687,56 +760,137 @@ func (db *TimescaleDatabase) GetGraph(ctx context.Context, req *ModelRequest, w
 		return err
 	}
 	defer rows.Close()
-	enc := rdf.NewTripleEncoder(w, rdf.Turtle)
-	log.Infof("Get graph %+v", req)
 
-	triplesBuffer := bytes.NewBuffer(nil)
-	dec := rdf.NewTripleDecoder(triplesBuffer, rdf.NTriples)
+	switch format {
+	case GraphFormatTurtle:
+		return streamGraphRDF(rows, w, rdf.Turtle)
+	case GraphFormatNTriples:
+		return streamGraphRDF(rows, w, rdf.NTriples)
+	case GraphFormatJSONLD:
+		return streamGraphJSONLD(rows, w)
+	case GraphFormatHDT:
+		// TODO: no pure-Go HDT encoder is wired in yet; this needs either a
+		// cgo binding to libhdt or a native writer for the dictionary +
+		// triples-bitmap layout.
+		return fmt.Errorf("HDT output is not yet supported")
+	default:
+		return fmt.Errorf("Unknown graph format %q", format)
+	}
+}
+
+// streamGraphRDF re-serializes rows from NTriples-shaped (s, p, o) text
+// columns into enc's format, one triple at a time: a goroutine writes each
+// row as an NTriples line into a pipe, while the decoder on the read end
+// hands triples to the encoder as they arrive. Only one triple is ever held
+// in memory, unlike the previous implementation, which buffered the entire
+// graph.
+func streamGraphRDF(rows pgx.Rows, w io.Writer, format rdf.Format) error {
+	pr, pw := io.Pipe()
 
-	a := 0
-	for rows.Next() {
-		var s, p, o string
-		if err := rows.Scan(&s, &p, &o); err != nil {
-			err = fmt.Errorf("Could not scan row: %s", err)
-			log.Error(err)
-			return err
+	go func() {
+		for rows.Next() {
+			var s, p, o string
+			if err := rows.Scan(&s, &p, &o); err != nil {
+				pw.CloseWithError(fmt.Errorf("Could not scan row: %w", err))
+				return
+			}
+			if _, err := fmt.Fprintf(pw, "%s %s %s .\n", s, p, o); err != nil {
+				pw.CloseWithError(fmt.Errorf("Could not write row: %w", err))
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			pw.CloseWithError(fmt.Errorf("Could not read rows: %w", err))
+			return
 		}
-		fmt.Println(s, p, o)
+		pw.Close()
+	}()
 
-		if a == 28269 {
-			fmt.Println(s, p, o)
+	dec := rdf.NewTripleDecoder(pr, rdf.NTriples)
+	enc := rdf.NewTripleEncoder(w, format)
+	for {
+		triple, err := dec.Decode()
+		if err == io.EOF {
+			break
 		}
-		if _, err := fmt.Fprintf(triplesBuffer, "%s %s %s .\n", s, p, o); err != nil {
-			err = fmt.Errorf("Could not write row into decoder: %s", err)
-			log.Error(err)
-			return err
+		if err != nil {
+			pr.CloseWithError(err)
+			return fmt.Errorf("Could not decode triple from database: %w", err)
+		}
+		if err := enc.Encode(triple); err != nil {
+			pr.CloseWithError(err)
+			return fmt.Errorf("Could not encode triple %s from database: %w", triple, err)
 		}
-		a += 1
 	}
+	return enc.Close()
+}
 
-	i := 0
-	for triple, err := dec.Decode(); err != io.EOF; triple, err = dec.Decode() {
-		if err != nil {
-			err = fmt.Errorf("Could not decode triple from database (%d): %s", i, err)
-			log.Error(err)
-			return err
-		} else if err := enc.Encode(triple); err != nil {
-			err = fmt.Errorf("Could not encode triple %s from database: %s", triple, err)
-			log.Error(err)
-			return err
+// streamGraphJSONLD writes rows as a JSON-LD document of the form
+// {"@graph": [{"@id": s, p: [{"@id"|"@value": o}]}, ...]}, grouping
+// consecutive rows by subject (the query orders by s, p, o) so the whole
+// graph never needs to be held in memory at once.
+func streamGraphJSONLD(rows pgx.Rows, w io.Writer) error {
+	enc := json.NewEncoder(w)
+
+	if _, err := io.WriteString(w, `{"@graph":[`); err != nil {
+		return err
+	}
+	var (
+		curSubj string
+		node    map[string]interface{}
+		first   = true
+	)
+	flush := func() error {
+		if node == nil {
+			return nil
+		}
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
 		}
-		i += 1
+		first = false
+		return enc.Encode(node)
 	}
 
-	return enc.Close()
+	for rows.Next() {
+		var s, p, o string
+		if err := rows.Scan(&s, &p, &o); err != nil {
+			return fmt.Errorf("Could not scan row: %w", err)
+		}
+		if s != curSubj {
+			if err := flush(); err != nil {
+				return fmt.Errorf("Could not write JSON-LD node: %w", err)
+			}
+			curSubj = s
+			node = map[string]interface{}{"@id": unquoteTerm(s)}
+		}
+		// node[p] is an array of objects, not a single value, so a subject
+		// with more than one triple for the same predicate (e.g. two
+		// rdf:type triples) doesn't lose all but the last.
+		key := unquoteTerm(p)
+		objs, _ := node[key].([]interface{})
+		node[key] = append(objs, jsonLDObject(o))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Could not read rows: %w", err)
+	}
+	if err := flush(); err != nil {
+		return fmt.Errorf("Could not write JSON-LD node: %w", err)
+	}
+
+	_, err := io.WriteString(w, "]}\n")
+	return err
+}
+
+func jsonLDObject(term string) map[string]interface{} {
+	if strings.HasPrefix(term, "<") {
+		return map[string]interface{}{"@id": unquoteTerm(term)}
+	}
+	return map[string]interface{}{"@value": unquoteTerm(term)}
 }
 
 type queryTask struct {
 	graph    string
 	queryIdx int
 }
-
-type queryResult struct {
-	queryTask
-	numSolutions int
-}
@@ -0,0 +1,412 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/knakk/sparql"
+)
+
+// This file implements a native, Postgres-backed SPARQL evaluator so a Mortar
+// deployment can run entirely against Timescale without standing up a
+// separate reasoner process (Reasoner.Mode = "embedded"). It understands a
+// pragmatic subset of SPARQL: SELECT queries built from a basic graph pattern
+// (BGP) of "?s p ?o ." triples, where any term may be a variable or a bound
+// URI/literal, and predicates may carry a "+" or "*" property-path suffix.
+// Path predicates are compiled to a recursive CTE; the rest of the BGP is
+// compiled to a chain of self-joins against the triples (and triples_inferred)
+// tables, with the final projection produced via json_agg so a single round
+// trip to Postgres returns bindings shaped like sparql.Results.
+
+var (
+	selectRe = regexp.MustCompile(`(?is)SELECT\s+(.+?)\s+WHERE\s*\{(.+)\}\s*$`)
+	varRe    = regexp.MustCompile(`^\?(\w+)$`)
+	pathRe   = regexp.MustCompile(`^(<[^>]+>)([+*])$`)
+	// qnameRe matches a prefixed name like "brick:Point" that isn't wrapped
+	// in angle brackets or a leading "?" - we don't resolve PREFIX
+	// declarations, so these must be rejected rather than silently
+	// mis-parsed as something else.
+	qnameRe = regexp.MustCompile(`^\w+:\w+$`)
+	// triplePatternRe matches one "s p o ." clause of a BGP. Each term is
+	// matched as a whole IRI (<...>), variable (?x), or string literal, so a
+	// dot inside a URI (e.g. "brickschema.org") is never mistaken for a
+	// clause terminator the way a naive strings.Split(body, ".") would.
+	triplePatternRe = regexp.MustCompile(`(?s)(<[^>]+>|\?\w+|"(?:[^"\\]|\\.)*"(?:@[\w-]+|\^\^<[^>]+>)?)\s+(<[^>]+>[+*]?|\?\w+)\s+(<[^>]+>|\?\w+|"(?:[^"\\]|\\.)*"(?:@[\w-]+|\^\^<[^>]+>)?)\s*\.`)
+)
+
+// sparqlTriplePattern is one "s p o ." clause of a BGP.
+type sparqlTriplePattern struct {
+	s, p, o string
+	// pathOp is "+" (one-or-more) or "*" (zero-or-more) when p is a property path.
+	pathOp string
+}
+
+// sparqlPlan is the parsed form of a SELECT ... WHERE { ... } query.
+type sparqlPlan struct {
+	vars     []string
+	patterns []sparqlTriplePattern
+}
+
+func isVar(term string) (string, bool) {
+	if m := varRe.FindStringSubmatch(term); m != nil {
+		return m[1], true
+	}
+	return "", false
+}
+
+// parseSparqlQuery parses the supported subset of SPARQL described above.
+func parseSparqlQuery(query string) (*sparqlPlan, error) {
+	m := selectRe.FindStringSubmatch(strings.TrimSpace(query))
+	if m == nil {
+		return nil, fmt.Errorf("embedded reasoner only supports SELECT ... WHERE { ... } queries")
+	}
+
+	var vars []string
+	if strings.TrimSpace(m[1]) == "*" {
+		vars = nil // resolved once the patterns are known
+	} else {
+		for _, tok := range strings.Fields(m[1]) {
+			name, ok := isVar(tok)
+			if !ok {
+				return nil, fmt.Errorf("unsupported projection term %q", tok)
+			}
+			vars = append(vars, name)
+		}
+	}
+
+	body := strings.TrimSpace(m[2])
+
+	var patterns []sparqlTriplePattern
+	for _, match := range triplePatternRe.FindAllStringSubmatch(body, -1) {
+		s, p, o := match[1], match[2], match[3]
+		tp := sparqlTriplePattern{s: s, p: p, o: o}
+		if pm := pathRe.FindStringSubmatch(p); pm != nil {
+			tp.p = pm[1]
+			tp.pathOp = pm[2]
+		}
+		patterns = append(patterns, tp)
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("query has no triple patterns understood by the embedded reasoner")
+	}
+	// If any non-whitespace text in the WHERE body wasn't consumed by a
+	// recognized triple pattern, the query contains a clause we don't
+	// understand - most commonly a prefixed name (e.g. "brick:Point"), since
+	// we don't resolve PREFIX declarations, but also FILTER/OPTIONAL/malformed
+	// patterns. Fail loudly instead of silently evaluating a subset of the
+	// query.
+	if leftover := strings.TrimSpace(triplePatternRe.ReplaceAllString(body, "")); len(leftover) > 0 {
+		if qnameRe.MatchString(leftover) {
+			return nil, fmt.Errorf("embedded reasoner does not resolve PREFIX declarations; use full <IRI> terms instead of prefixed name %q", leftover)
+		}
+		return nil, fmt.Errorf("unsupported clause in WHERE body: %q", leftover)
+	}
+
+	if vars == nil {
+		seen := make(map[string]bool)
+		for _, tp := range patterns {
+			for _, term := range []string{tp.s, tp.p, tp.o} {
+				if name, ok := isVar(term); ok && !seen[name] {
+					seen[name] = true
+					vars = append(vars, name)
+				}
+			}
+		}
+	}
+
+	return &sparqlPlan{vars: vars, patterns: patterns}, nil
+}
+
+// compileToSQL lowers a sparqlPlan into a single SQL statement scoped to the
+// named graph (source), unioning base and forward-chained triples. The
+// returned query projects one JSON object per solution via json_agg, so the
+// caller gets all bindings back in a single round trip.
+func (plan *sparqlPlan) compileToSQL(graph string) (string, []interface{}) {
+	var (
+		ctes   []string
+		from   []string
+		where  []string
+		args   = []interface{}{graph}
+		fields []string
+	)
+
+	triplesSrc := `(SELECT s, p, o FROM triples WHERE source = $1
+					 UNION ALL
+					 SELECT s, p, o FROM triples_inferred WHERE source = $1)`
+
+	for i, tp := range plan.patterns {
+		alias := fmt.Sprintf("t%d", i)
+
+		if tp.pathOp != "" {
+			// one-or-more property path over a single fixed predicate, compiled
+			// to a recursive CTE (declared up front in a WITH RECURSIVE prefix,
+			// not inlined into the FROM list - a recursive CTE can only be
+			// referenced there, not defined there) so arbitrary-depth chains
+			// (e.g. rdfs:subClassOf+) resolve in one query instead of N round trips.
+			cteName := fmt.Sprintf("path%d", i)
+			args = append(args, tp.p, graph)
+			pArg, sourceArg := len(args)-1, len(args)
+			ctes = append(ctes, fmt.Sprintf(`%s AS (
+				SELECT s, o FROM triples WHERE p = $%d AND source = $%d
+				UNION
+				SELECT r.s, t.o FROM %s r JOIN triples t ON t.s = r.o AND t.p = $%d AND t.source = $%d
+			)`, cteName, pArg, sourceArg, cteName, pArg, sourceArg))
+
+			fromItem := fmt.Sprintf("%s %s", cteName, alias)
+			if tp.pathOp == "*" {
+				// zero-or-more also matches a node to itself, for every node
+				// that appears as a subject or object of the path's predicate.
+				fromItem = fmt.Sprintf(`(SELECT s, o FROM %s
+					UNION
+					SELECT n, n FROM (
+						SELECT s AS n FROM triples WHERE p = $%d AND source = $%d
+						UNION
+						SELECT o AS n FROM triples WHERE p = $%d AND source = $%d
+					) nodes
+				) %s`, cteName, pArg, sourceArg, pArg, sourceArg, alias)
+			}
+			from = append(from, fromItem)
+
+			for _, col := range []string{"s", "o"} {
+				term := tp.s
+				if col == "o" {
+					term = tp.o
+				}
+				where = append(where, bindTerm(alias, col, term, plan.patterns[:i], &args)...)
+			}
+			continue
+		}
+
+		from = append(from, triplesSrc+" "+alias)
+		for _, col := range []string{"s", "p", "o"} {
+			term := map[string]string{"s": tp.s, "p": tp.p, "o": tp.o}[col]
+			where = append(where, bindTerm(alias, col, term, plan.patterns[:i], &args)...)
+		}
+	}
+
+	for _, v := range plan.vars {
+		col, alias := "", ""
+		for i, tp := range plan.patterns {
+			if c := colOf(tp, v); c != "" {
+				col, alias = c, fmt.Sprintf("t%d", i)
+				break
+			}
+		}
+		fields = append(fields, fmt.Sprintf(`%s.%s AS "%s"`, alias, col, v))
+	}
+
+	whereClause := "TRUE"
+	if len(where) > 0 {
+		whereClause = strings.Join(where, " AND ")
+	}
+	withClause := ""
+	if len(ctes) > 0 {
+		withClause = "WITH RECURSIVE " + strings.Join(ctes, ", ") + " "
+	}
+	sql := fmt.Sprintf(
+		"%sSELECT COALESCE(json_agg(row_to_json(sol)), '[]') FROM (SELECT %s FROM %s WHERE %s) sol",
+		withClause, strings.Join(fields, ", "), strings.Join(from, ", "), whereClause)
+	return sql, args
+}
+
+// bindTerm produces the WHERE-clause fragment (and any bind args) needed to
+// constrain alias.col to term: a self-join condition if term is a variable
+// already bound by an earlier pattern, a parameter equality if it's bound for
+// the first time, or nothing if it's a variable appearing for the first time.
+func bindTerm(alias, col, term string, earlier []sparqlTriplePattern, args *[]interface{}) []string {
+	name, ok := isVar(term)
+	if !ok {
+		// triples.s/p/o store IRIs bracket-wrapped (e.g. "<http://...>"), the
+		// same form RegisterStream/AddTriples write them in, so term is bound
+		// as-is rather than unquoted.
+		*args = append(*args, term)
+		return []string{fmt.Sprintf("%s.%s = $%d", alias, col, len(*args))}
+	}
+	for j, tp := range earlier {
+		if c := colOf(tp, name); c != "" {
+			return []string{fmt.Sprintf("%s.%s = t%d.%s", alias, col, j, c)}
+		}
+	}
+	return nil
+}
+
+func colOf(tp sparqlTriplePattern, name string) string {
+	if n, ok := isVar(tp.s); ok && n == name {
+		return "s"
+	}
+	// tp.p is only ever a variable for a non-path pattern (pathRe requires a
+	// bracketed IRI before the +/* suffix, so a path's predicate is never a
+	// var), and the "p" column only exists on the triplesSrc FROM item
+	// compileToSQL uses there - never on a property path's CTE - so this is
+	// safe without checking tp.pathOp.
+	if n, ok := isVar(tp.p); ok && n == name {
+		return "p"
+	}
+	if n, ok := isVar(tp.o); ok && n == name {
+		return "o"
+	}
+	return ""
+}
+
+func unquoteTerm(term string) string {
+	term = strings.TrimPrefix(term, "<")
+	term = strings.TrimSuffix(term, ">")
+	return strings.Trim(term, `"`)
+}
+
+// querySparqlEmbedded evaluates a SELECT query directly against the triples
+// tables and returns results shaped like the knakk/sparql client would, so
+// callers (QuerySparql, QuerySparqlWriter, Qualify) don't need to know which
+// backend answered the query.
+func (db *TimescaleDatabase) querySparqlEmbedded(ctx context.Context, graph string, query string) (*sparql.Results, error) {
+	plan, err := parseSparqlQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse SPARQL query: %w", err)
+	}
+	sql, args := plan.compileToSQL(graph)
+
+	var raw []map[string]interface{}
+	if err := db.pool.QueryRow(ctx, sql, args...).Scan(&rawJSON{&raw}); err != nil {
+		return nil, fmt.Errorf("Could not evaluate SPARQL query: %w", err)
+	}
+
+	res := &sparql.Results{}
+	res.Head.Vars = plan.vars
+	for _, row := range raw {
+		binding := make(map[string]sparql.Binding, len(plan.vars))
+		for _, v := range plan.vars {
+			raw, _ := row[v].(string)
+			// bindings returned to callers are SPARQL term values, not the
+			// bracket-wrapped form triples are stored in, so unquote here -
+			// the bracket form only matters for binding query parameters.
+			val := unquoteTerm(raw)
+			binding[v] = sparql.Binding{
+				Type:  bindingType(val),
+				Value: val,
+			}
+		}
+		res.Results.Bindings = append(res.Results.Bindings, binding)
+	}
+	return res, nil
+}
+
+// resolveSparqlStreamIds runs a SPARQL query and joins the resulting URIs
+// against streams in a single statement, avoiding the separate SPARQL +
+// streams round trips writeMetadataArrow otherwise needs.
+func (db *TimescaleDatabase) resolveSparqlStreamIds(ctx context.Context, graph, query string, sources []string) ([]int64, error) {
+	plan, err := parseSparqlQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse SPARQL query: %w", err)
+	}
+	sql, args := plan.compileToSQL(graph)
+
+	// kv.value comes back bracket-wrapped (the form triples are stored in,
+	// see bindTerm) while streams.name/brick_uri are stored bare, so strip
+	// the brackets before comparing.
+	joined := fmt.Sprintf(`SELECT DISTINCT s.id FROM streams s, json_array_elements((%s)) AS b,
+								json_each_text(b) AS kv
+							WHERE (s.name = trim(both '<>' from kv.value) OR s.brick_uri = trim(both '<>' from kv.value))`, sql)
+	if len(sources) > 0 {
+		args = append(args, sources)
+		joined += fmt.Sprintf(" AND s.source = ANY($%d)", len(args))
+	}
+
+	rows, err := db.pool.Query(ctx, joined, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Could not resolve SPARQL stream ids: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("Could not resolve SPARQL stream ids: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func bindingType(value string) string {
+	if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
+		return "uri"
+	}
+	return "literal"
+}
+
+// materializeInferred performs a small, pragmatic OWL-RL-style forward chain
+// over the triples just written for source: rdfs:subClassOf and
+// rdfs:subPropertyOf are followed transitively so downstream SPARQL queries
+// see inferred rdf:type and property triples without re-deriving them at
+// query time. Results are written into triples_inferred inside the caller's
+// transaction so AddTriples stays atomic.
+func (db *TimescaleDatabase) materializeInferred(ctx context.Context, txn pgx.Tx, source string) error {
+	const rdfType = "<http://www.w3.org/1999/02/22-rdf-syntax-ns#type>"
+	const subClassOf = "<http://www.w3.org/2000/01/rdf-schema#subClassOf>"
+	const subPropertyOf = "<http://www.w3.org/2000/01/rdf-schema#subPropertyOf>"
+
+	// time is part of the (source, origin, time, s, p, o) primary key, so
+	// inserting with now() would defeat ON CONFLICT DO NOTHING across
+	// repeated AddTriples calls for the same source and leave every prior
+	// materialization's rows behind. Clear the old inferred set first.
+	if _, err := txn.Exec(ctx, `DELETE FROM triples_inferred WHERE source = $1 AND origin = 'inferred'`, source); err != nil {
+		return fmt.Errorf("Could not clear prior inferred triples: %w", err)
+	}
+
+	_, err := txn.Exec(ctx, `
+		INSERT INTO triples_inferred(source, origin, time, s, p, o)
+		SELECT DISTINCT $1, 'inferred', now(), typ.s, $2, anc.o
+		FROM (SELECT s, o FROM triples WHERE source = $1 AND p = $2) typ
+		JOIN (
+			WITH RECURSIVE closure(s, o) AS (
+				SELECT s, o FROM triples WHERE source = $1 AND p = $3
+				UNION
+				SELECT c.s, t.o FROM closure c JOIN triples t ON t.s = c.o AND t.p = $3 AND t.source = $1
+			)
+			SELECT * FROM closure
+		) anc ON anc.s = typ.o
+		ON CONFLICT (source, origin, time, s, p, o) DO NOTHING`,
+		source, rdfType, subClassOf)
+	if err != nil {
+		return fmt.Errorf("Could not materialize subClassOf closure: %w", err)
+	}
+
+	_, err = txn.Exec(ctx, `
+		INSERT INTO triples_inferred(source, origin, time, s, p, o)
+		SELECT DISTINCT $1, 'inferred', now(), base.s, anc.o, base.o
+		FROM (SELECT s, p, o FROM triples WHERE source = $1) base
+		JOIN (
+			WITH RECURSIVE closure(s, o) AS (
+				SELECT s, o FROM triples WHERE source = $1 AND p = $2
+				UNION
+				SELECT c.s, t.o FROM closure c JOIN triples t ON t.s = c.o AND t.p = $2 AND t.source = $1
+			)
+			SELECT * FROM closure
+		) anc ON anc.s = base.p
+		ON CONFLICT (source, origin, time, s, p, o) DO NOTHING`,
+		source, subPropertyOf)
+	if err != nil {
+		return fmt.Errorf("Could not materialize subPropertyOf closure: %w", err)
+	}
+
+	return nil
+}
+
+// rawJSON decodes a jsonb/json column directly into a Go value via pgx's
+// Scan, sidestepping an intermediate []byte + json.Unmarshal call site.
+type rawJSON struct {
+	dest interface{}
+}
+
+func (r *rawJSON) Scan(src interface{}) error {
+	b, ok := src.([]byte)
+	if !ok {
+		return fmt.Errorf("rawJSON: unsupported source type %T", src)
+	}
+	return json.Unmarshal(b, r.dest)
+}
@@ -0,0 +1,288 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/flight"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+)
+
+// defaultTargetBatchBytes replaces the old "flush every 2,000,000 readings"
+// heuristic: batches are flushed once their estimated encoded size crosses
+// this threshold, regardless of row count, so wide or narrow rows both
+// produce reasonably-sized Arrow record batches.
+const defaultTargetBatchBytes = 8 * 1024 * 1024 // 8 MiB
+
+// bytesPerReading estimates the wire size of one (time, value, id) reading:
+// an 8-byte timestamp, an 8-byte float64, and the UTF-8 id/name string.
+func bytesPerReading(name string) int64 {
+	return 8 + 8 + int64(len(name))
+}
+
+func dataChunkSchema() *arrow.Schema {
+	return arrow.NewSchema([]arrow.Field{
+		{Name: "time", Type: arrow.FixedWidthTypes.Timestamp_ns, Nullable: false},
+		{Name: "value", Type: arrow.PrimitiveTypes.Float64, Nullable: false},
+		{Name: "id", Type: arrow.BinaryTypes.String, Nullable: false},
+	}, nil)
+}
+
+// writeDataArrow streams the readings matched by q as Arrow IPC record
+// batches, flushing whenever the current batch's estimated size crosses
+// targetBatchBytes. It underlies both ReadDataChunk (HTTP/LZ4) and the
+// Flight service's DoGet (gRPC, flow-controlled).
+func (db *TimescaleDatabase) writeDataArrow(ctx context.Context, w io.Writer, q *Query, targetBatchBytes int64) error {
+	sch := dataChunkSchema()
+	bldr := array.NewRecordBuilder(memory.DefaultAllocator, sch)
+	defer bldr.Release()
+
+	rTimes := bldr.Field(0).(*array.TimestampBuilder)
+	rValues := bldr.Field(1).(*array.Float64Builder)
+	rNames := bldr.Field(2).(*array.StringBuilder)
+
+	arrowWriter := ipc.NewWriter(w, ipc.WithSchema(bldr.Schema()))
+
+	rows, err := db.queryDataRows(ctx, q)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var pendingBytes int64
+	flush := func() error {
+		rec := bldr.NewRecord()
+		defer rec.Release()
+		if err := arrowWriter.Write(rec); err != nil {
+			return fmt.Errorf("Could not write record %w", err)
+		}
+		pendingBytes = 0
+		return nil
+	}
+
+	for rows.Next() {
+		var (
+			t time.Time
+			v float64
+			s string
+		)
+		if err := rows.Scan(&t, &v, &s); err != nil {
+			return fmt.Errorf("Could not query %w", err)
+		}
+		rTimes.Append(arrow.Timestamp(t.UnixNano()))
+		rValues.Append(v)
+		rNames.Append(s)
+		pendingBytes += bytesPerReading(s)
+
+		if pendingBytes >= targetBatchBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	return arrowWriter.Close()
+}
+
+// queryDataRows runs the (possibly aggregated) time-range query behind
+// ReadDataChunk/writeDataArrow.
+func (db *TimescaleDatabase) queryDataRows(ctx context.Context, q *Query) (pgx.Rows, error) {
+	if q.AggregationFunc != nil && q.AggregationWindow != nil {
+		sql := fmt.Sprintf(`SELECT time_bucket('%s', time) as time, %s, COALESCE(brick_uri, name)
+							FROM unified WHERE time>=$1 and time <=$2 and stream_id = ANY($3)
+							GROUP BY time, stream_id, brick_uri, name`, *q.AggregationWindow, q.AggregationFunc.toSQL("value"))
+		return db.pool.Query(ctx, sql, q.Start.Format(time.RFC3339), q.End.Format(time.RFC3339), q.Ids)
+	}
+	return db.pool.Query(ctx, `SELECT time, value, COALESCE(brick_uri, name)
+								FROM unified WHERE time>=$1 and time <=$2 and stream_id = ANY($3)`,
+		q.Start.Format(time.RFC3339), q.End.Format(time.RFC3339), q.Ids)
+}
+
+// FlightServer exposes Mortar's time-range and SPARQL queries over Arrow
+// Flight (grpc); it has no Flight SQL surface. New clients can stream record batches
+// directly with backpressure instead of going through the LZ4-wrapped HTTP
+// path in ReadDataChunk. shardSize bounds how many stream ids are served per
+// endpoint, so GetFlightInfo can hand back multiple DoGet endpoints that a
+// client can fetch in parallel.
+type FlightServer struct {
+	flight.BaseFlightServer
+
+	db               *TimescaleDatabase
+	targetBatchBytes int64
+	shardSize        int
+}
+
+// NewFlightServer constructs a FlightServer backed by db. targetBatchBytes
+// and shardSize fall back to sensible defaults when zero.
+func NewFlightServer(db *TimescaleDatabase, targetBatchBytes int64, shardSize int) *FlightServer {
+	if targetBatchBytes <= 0 {
+		targetBatchBytes = defaultTargetBatchBytes
+	}
+	if shardSize <= 0 {
+		shardSize = 500
+	}
+	return &FlightServer{db: db, targetBatchBytes: targetBatchBytes, shardSize: shardSize}
+}
+
+// flightTicket is the (JSON-encoded) payload carried in a flight.Ticket: a
+// single shard of a larger Query, so DoGet can be called independently, in
+// parallel, per shard.
+type flightTicket struct {
+	Query
+	Shard int `json:"shard"`
+}
+
+// GetFlightInfo plans a query described by desc.Cmd (a JSON-encoded Query)
+// into one endpoint per shard of stream ids, so a client can fan the DoGet
+// calls out in parallel.
+func (s *FlightServer) GetFlightInfo(ctx context.Context, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+	var q Query
+	if err := json.Unmarshal(desc.Cmd, &q); err != nil {
+		return nil, fmt.Errorf("Could not decode flight descriptor: %w", err)
+	}
+
+	var endpoints []*flight.FlightEndpoint
+	for shard, ids := range shardIds(q.Ids, s.shardSize) {
+		shardQuery := q
+		shardQuery.Ids = ids
+		ticket, err := json.Marshal(flightTicket{Query: shardQuery, Shard: shard})
+		if err != nil {
+			return nil, fmt.Errorf("Could not encode flight ticket: %w", err)
+		}
+		endpoints = append(endpoints, &flight.FlightEndpoint{
+			Ticket: &flight.Ticket{Ticket: ticket},
+		})
+	}
+
+	return &flight.FlightInfo{
+		Schema:           flight.SerializeSchema(dataChunkSchema(), memory.DefaultAllocator),
+		FlightDescriptor: desc,
+		Endpoint:         endpoints,
+		TotalRecords:     -1,
+		TotalBytes:       -1,
+	}, nil
+}
+
+// DoGet streams one shard's readings as Arrow IPC record batches over the
+// Flight data stream, resolving the shard's Ids first (if the ticket carries
+// a Sparql/Uris query instead) and using the same batching logic (and
+// target-bytes knob) as the HTTP/LZ4 path.
+//
+// Unlike ReadDataChunk, it does not also send a metadata batch: a Flight
+// stream carries exactly one schema (the one GetFlightInfo advertised,
+// dataChunkSchema()), and the metadata batch's schema
+// ({brick_class,brick_uri,units,name,stream_id}) doesn't match it - the HTTP
+// path only gets away with this by concatenating two self-describing IPC
+// streams, which isn't representable on a single Flight stream. A client
+// that needs stream metadata should fetch it separately (e.g. over HTTP).
+func (s *FlightServer) DoGet(tkt *flight.Ticket, fs flight.FlightService_DoGetServer) error {
+	var ticket flightTicket
+	if err := json.Unmarshal(tkt.Ticket, &ticket); err != nil {
+		return fmt.Errorf("Could not decode flight ticket: %w", err)
+	}
+
+	if err := s.db.resolveQueryIds(fs.Context(), &ticket.Query); err != nil {
+		return fmt.Errorf("Could not resolve stream ids: %w", err)
+	}
+
+	writer := flight.NewRecordWriter(fs, ipc.WithSchema(dataChunkSchema()))
+	defer writer.Close()
+
+	return streamArrow(writer, func(w io.Writer) error {
+		return s.db.writeDataArrow(fs.Context(), w, &ticket.Query, s.targetBatchBytes)
+	})
+}
+
+// recordWriter is the subset of *flight.Writer that streamArrow needs.
+type recordWriter interface {
+	Write(arrow.Record) error
+}
+
+// streamArrow runs produce against the write end of a pipe and copies every
+// record batch it writes (as an Arrow IPC stream) onto writer, so DoGet/
+// DoExchange can relay writeDataArrow's output - which writes a full IPC
+// stream of its own - as Flight record batches
+// without buffering the whole stream in memory.
+func streamArrow(writer recordWriter, produce func(io.Writer) error) error {
+	pr, pw := io.Pipe()
+
+	errc := make(chan error, 1)
+	go func() {
+		defer pw.Close()
+		errc <- produce(pw)
+	}()
+
+	reader, err := ipc.NewReader(pr)
+	if err != nil {
+		return fmt.Errorf("Could not read arrow stream: %w", err)
+	}
+	defer reader.Release()
+	for reader.Next() {
+		if err := writer.Write(reader.Record()); err != nil {
+			return fmt.Errorf("Could not stream record: %w", err)
+		}
+	}
+
+	return <-errc
+}
+
+// DoExchange reads a single Query descriptor (its AggregationFunc/
+// AggregationWindow, same as a regular DoGet ticket) and streams the
+// server-computed result back, in the same shape DoGet produces.
+//
+// It does NOT consume client-pushed record batches: there is no server-side
+// aggregation pushdown over client-supplied data, and no Flight SQL/substrait
+// surface for translating aggregation windows into substrait plans.
+// DoExchange here is just DoGet reachable over the bidirectional-streaming
+// RPC for clients that already hold that connection open. Those two pieces
+// of the original request are not delivered by this change and are left as
+// follow-up work rather than guessed at.
+func (s *FlightServer) DoExchange(fs flight.FlightService_DoExchangeServer) error {
+	req, err := fs.Recv()
+	if err != nil {
+		return fmt.Errorf("Could not read exchange descriptor: %w", err)
+	}
+	var q Query
+	if err := json.Unmarshal(req.FlightDescriptor.Cmd, &q); err != nil {
+		return fmt.Errorf("Could not decode exchange query: %w", err)
+	}
+
+	if err := s.db.resolveQueryIds(fs.Context(), &q); err != nil {
+		return fmt.Errorf("Could not resolve stream ids: %w", err)
+	}
+
+	writer := flight.NewRecordWriter(fs, ipc.WithSchema(dataChunkSchema()))
+	defer writer.Close()
+
+	return streamArrow(writer, func(w io.Writer) error {
+		return s.db.writeDataArrow(fs.Context(), w, &q, s.targetBatchBytes)
+	})
+}
+
+// shardIds splits ids into chunks of at most size, preserving order.
+func shardIds(ids []int64, size int) [][]int64 {
+	if len(ids) == 0 {
+		return [][]int64{nil}
+	}
+	var shards [][]int64
+	for i := 0; i < len(ids); i += size {
+		end := i + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+		shards = append(shards, ids[i:end])
+	}
+	return shards
+}
@@ -0,0 +1,270 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/pierrec/lz4"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// hybridDatabase composes a MetadataStore with an independently-chosen
+// TSStore, so a site can reuse Mortar's Brick+SPARQL layer (always Postgres)
+// while pointing readings at whatever time-series engine it already runs.
+type hybridDatabase struct {
+	MetadataStore
+	TSStore
+}
+
+// Close shuts down both the metadata and time-series backends.
+func (h *hybridDatabase) Close() {
+	h.MetadataStore.Close()
+	if closer, ok := h.TSStore.(interface{ Close() }); ok {
+		closer.Close()
+	}
+}
+
+// influxTSStore is a TSStore backed by InfluxDB (line protocol writes, Flux
+// reads), used instead of Timescale's hypertables when cfg.Database.Driver
+// is "influx". It maps InsertHistoricalData/ReadDataChunk onto the same
+// Arrow output schema the Timescale TSStore produces, so HTTP callers don't
+// need to know which backend answered. The Flight service in flight.go reads
+// from Timescale only and does not use this store.
+type influxTSStore struct {
+	client influxdb2.Client
+	org    string
+	bucket string
+	// metadata is the same Postgres-backed MetadataStore used for the streams
+	// table, so the TSStore can run the same auth check and stream id lookup
+	// InsertHistoricalData's Timescale counterpart does.
+	metadata *TimescaleDatabase
+	// streamNames resolves a stream_id (as used by Query.Ids) to the name/
+	// brick_uri written into the "id" field of the Arrow output, since Influx
+	// has no notion of the streams table itself.
+	streamNames func(ctx context.Context, ids []int64) (map[int64]string, error)
+}
+
+func newInfluxDatabaseFromConfig(ctx context.Context, cfg *config.Config) (Database, error) {
+	tsdb, err := newTimescaleFromConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	metadata := tsdb.(*TimescaleDatabase)
+	pool := metadata.pool
+
+	log := logging.FromContext(ctx)
+	client := influxdb2.NewClient(cfg.Database.InfluxURL, cfg.Database.InfluxToken)
+	if ok, err := client.Ping(ctx); err != nil || !ok {
+		return nil, fmt.Errorf("Could not connect to InfluxDB at %s: %w", cfg.Database.InfluxURL, err)
+	}
+	log.Infof("Connected to InfluxDB at %s (bucket %s)", cfg.Database.InfluxURL, cfg.Database.InfluxBucket)
+
+	ts := &influxTSStore{
+		client:   client,
+		org:      cfg.Database.InfluxOrg,
+		bucket:   cfg.Database.InfluxBucket,
+		metadata: metadata,
+		streamNames: func(ctx context.Context, ids []int64) (map[int64]string, error) {
+			rows, err := pool.Query(ctx, `SELECT id, COALESCE(brick_uri, name) FROM streams WHERE id = ANY($1)`, ids)
+			if err != nil {
+				return nil, err
+			}
+			defer rows.Close()
+			names := make(map[int64]string, len(ids))
+			for rows.Next() {
+				var id int64
+				var name string
+				if err := rows.Scan(&id, &name); err != nil {
+					return nil, err
+				}
+				names[id] = name
+			}
+			return names, nil
+		},
+	}
+
+	return &hybridDatabase{MetadataStore: metadata, TSStore: ts}, nil
+}
+
+// InsertHistoricalData writes ds's readings as Influx line protocol points,
+// tagged with the stream id so ReadDataChunk can query them back out by id.
+func (ts *influxTSStore) InsertHistoricalData(ctx context.Context, ds Dataset) error {
+	if err := checkDataset(ds); err != nil {
+		return fmt.Errorf("Cannot handle invalid dataset: %w", err)
+	}
+
+	// if the source does not exist, the checkAuth function will fail
+	if authorized, err := ts.metadata.checkAuth(ctx, "write", ds.GetSource()); err != nil {
+		return fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return fmt.Errorf("Cannot write to source: %s", ds.GetSource())
+	}
+
+	row := ts.metadata.pool.QueryRow(ctx, `SELECT id FROM streams WHERE source=$1 AND name=$2`, ds.GetSource(), ds.GetName())
+	var streamID int
+	if err := row.Scan(&streamID); err != nil {
+		return fmt.Errorf("No such stream (SourceName: %s, Name: %s): %w", ds.GetSource(), ds.GetName(), err)
+	}
+	ds.SetId(streamID)
+
+	writeAPI := ts.client.WriteAPIBlocking(ts.org, ts.bucket)
+	for _, rdg := range ds.GetReadings() {
+		p := influxdb2.NewPoint("reading",
+			map[string]string{"stream_id": fmt.Sprintf("%d", ds.GetId())},
+			map[string]interface{}{"value": rdg.Value},
+			rdg.Time)
+		if err := writeAPI.WritePoint(ctx, p); err != nil {
+			return fmt.Errorf("Cannot insert readings for id %d: %w", ds.GetId(), err)
+		}
+	}
+	return nil
+}
+
+// ReadDataChunk runs a Flux range+aggregateWindow query over q's stream ids
+// and writes the results in the same LZ4-wrapped form as the Timescale
+// TSStore's ReadDataChunk (a metadata IPC stream, then a data IPC stream with
+// the same Arrow schema), so HTTP clients see one wire format regardless of
+// backend. All readings go out in a single record batch; they are not split
+// by target batch size.
+func (ts *influxTSStore) ReadDataChunk(ctx context.Context, httpw io.Writer, q *Query) error {
+	w := lz4.NewWriter(httpw)
+	defer w.Close()
+
+	// writeMetadataArrow also resolves q.Sparql/q.Uris into q.Ids.
+	if err := ts.metadata.writeMetadataArrow(ctx, w, q); err != nil {
+		return fmt.Errorf("Error processing metadata: %w", err)
+	}
+
+	names, err := ts.streamNames(ctx, q.Ids)
+	if err != nil {
+		return fmt.Errorf("Could not resolve stream names: %w", err)
+	}
+
+	sch := dataChunkSchema()
+	bldr := array.NewRecordBuilder(memory.DefaultAllocator, sch)
+	defer bldr.Release()
+	rTimes := bldr.Field(0).(*array.TimestampBuilder)
+	rValues := bldr.Field(1).(*array.Float64Builder)
+	rNames := bldr.Field(2).(*array.StringBuilder)
+
+	queryAPI := ts.client.QueryAPI(ts.org)
+	flux := buildFluxQuery(ts.bucket, q)
+	result, err := queryAPI.Query(ctx, flux)
+	if err != nil {
+		return fmt.Errorf("Could not query InfluxDB: %w", err)
+	}
+	defer result.Close()
+
+	arrowWriter := ipc.NewWriter(w, ipc.WithSchema(bldr.Schema()))
+	for result.Next() {
+		rec := result.Record()
+		id, err := parseStreamIDTag(rec.ValueByKey("stream_id"))
+		if err != nil {
+			return fmt.Errorf("Could not parse stream_id tag: %w", err)
+		}
+		rTimes.Append(arrow.Timestamp(rec.Time().UnixNano()))
+		rValues.Append(toFloat64(rec.Value()))
+		rNames.Append(names[id])
+	}
+	if result.Err() != nil {
+		return fmt.Errorf("Could not read InfluxDB query results: %w", result.Err())
+	}
+
+	out := bldr.NewRecord()
+	defer out.Release()
+	if err := arrowWriter.Write(out); err != nil {
+		return fmt.Errorf("Could not write record %w", err)
+	}
+	return arrowWriter.Close()
+}
+
+func (ts *influxTSStore) Close() {
+	ts.client.Close()
+}
+
+// buildFluxQuery translates a Query's time range, stream ids, and optional
+// aggregation window into Flux, mirroring the time_bucket SQL the Timescale
+// TSStore generates.
+func buildFluxQuery(bucket string, q *Query) string {
+	filter := fmt.Sprintf(`from(bucket: "%s")
+		|> range(start: %s, stop: %s)
+		|> filter(fn: (r) => r._measurement == "reading" and r._field == "value")
+		|> filter(fn: (r) => contains(value: r.stream_id, set: %s))`,
+		bucket, q.Start.Format(fluxTimeFormat), q.End.Format(fluxTimeFormat), fluxStreamIDSet(q.Ids))
+
+	if q.AggregationFunc != nil && q.AggregationWindow != nil {
+		return fmt.Sprintf(`%s
+		|> aggregateWindow(every: %s, fn: %s, createEmpty: false)`,
+			filter, *q.AggregationWindow, fluxAggregationFunc(*q.AggregationFunc))
+	}
+	return filter
+}
+
+// fluxAggregationFunc maps an AggregationFunc onto the Flux builtin that
+// computes it. Flux's names don't all match the SQL aggregates the Timescale
+// TSStore emits via AggregationFunc.toSQL (notably "avg" is "mean" in Flux),
+// so this can't be derived generically from the Go value's string form.
+func fluxAggregationFunc(fn AggregationFunc) string {
+	switch strings.ToLower(fmt.Sprintf("%v", fn)) {
+	case "avg", "average", "mean":
+		return "mean"
+	case "sum":
+		return "sum"
+	case "min":
+		return "min"
+	case "max":
+		return "max"
+	case "count":
+		return "count"
+	default:
+		return "mean"
+	}
+}
+
+const fluxTimeFormat = "2006-01-02T15:04:05Z07:00"
+
+// fluxStreamIDSet renders ids as a Flux array literal of the stream_id tag's
+// string form (InsertHistoricalData writes it via fmt.Sprintf("%d", ...)),
+// for use in a `contains(value: r.stream_id, set: ...)` filter. Without this
+// filter, ReadDataChunk would return every stream's readings in the bucket
+// for the time range instead of just q.Ids - a cross-source data leak.
+func fluxStreamIDSet(ids []int64) string {
+	quoted := make([]string, len(ids))
+	for i, id := range ids {
+		quoted[i] = fmt.Sprintf("%q", fmt.Sprintf("%d", id))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+func parseStreamIDTag(v interface{}) (int64, error) {
+	var id int64
+	_, err := fmt.Sscanf(fmt.Sprintf("%v", v), "%d", &id)
+	return id, err
+}
+
+// toFloat64 normalizes a Flux result value to float64. count-aggregated
+// readings come back as int64 (uint64 for some client versions), not
+// float64, so those need converting rather than falling through to the
+// zero value a bare type assertion would produce.
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int64:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,94 @@
+package database
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"net/url"
+
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/pgx"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// newMigrator builds a golang-migrate Migrate instance over cfg's Postgres
+// connection and the embedded migrations/ directory, so the binary carries
+// its own schema history and doesn't need the .sql files deployed alongside it.
+func newMigrator(cfg *config.Config) (*migrate.Migrate, error) {
+	src, err := iofs.New(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("Could not load embedded migrations: %w", err)
+	}
+
+	dbURL := fmt.Sprintf("pgx://%s/%s?sslmode=disable&user=%s&password=%s&port=%s",
+		cfg.Database.Host, cfg.Database.Database, cfg.Database.User, url.QueryEscape(cfg.Database.Password), cfg.Database.Port)
+	m, err := migrate.NewWithSourceInstance("iofs", src, dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("Could not set up migrator: %w", err)
+	}
+	return m, nil
+}
+
+// RunMigrations applies all pending up migrations. It runs automatically
+// from connectPostgres when cfg.Database.AutoMigrate is set, and backs
+// `mortar migrate up`.
+func RunMigrations(ctx context.Context, cfg *config.Config) error {
+	log := logging.FromContext(ctx)
+
+	m, err := newMigrator(cfg)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
+		return fmt.Errorf("Could not run migrations: %w", err)
+	}
+	if version, dirty, err := m.Version(); err == nil {
+		log.Infof("Database schema at migration %d (dirty=%v)", version, dirty)
+	}
+	return nil
+}
+
+// MigrateDown rolls back every applied migration. Backs `mortar migrate down`.
+func MigrateDown(ctx context.Context, cfg *config.Config) error {
+	m, err := newMigrator(cfg)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err := m.Down(); err != nil && err != migrate.ErrNoChange {
+		return fmt.Errorf("Could not roll back migrations: %w", err)
+	}
+	return nil
+}
+
+// MigrateVersion reports the current schema version and dirty state. Backs
+// `mortar migrate version`.
+func MigrateVersion(cfg *config.Config) (version uint, dirty bool, err error) {
+	m, err := newMigrator(cfg)
+	if err != nil {
+		return 0, false, err
+	}
+	defer m.Close()
+	return m.Version()
+}
+
+// MigrateForce sets the schema version without running any migration, to
+// recover from a dirty state left by a failed migration. Backs
+// `mortar migrate force N`.
+func MigrateForce(cfg *config.Config, version int) error {
+	m, err := newMigrator(cfg)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	return m.Force(version)
+}
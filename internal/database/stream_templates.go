@@ -0,0 +1,146 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"gopkg.in/yaml.v2"
+)
+
+// streamTemplate is one Graphite-style naming convention for a source, e.g.
+// Pattern "equip.equip_id.point_type" with Separator "." turns the stream
+// name "ahu.1.sat" into fields {equip: "ahu", equip_id: "1", point_type:
+// "sat"}. Filter is a glob the raw stream name must match (via
+// filepath.Match) before the template is tried; templates are tried in id
+// order and the first match wins.
+type streamTemplate struct {
+	id        int64
+	source    string
+	filter    string
+	pattern   string
+	separator string
+}
+
+// match reports whether name satisfies the template's filter and field
+// count, returning the bound fields keyed by the pattern's field names.
+func (t streamTemplate) match(name string) (map[string]string, bool) {
+	if len(t.filter) > 0 {
+		if ok, err := filepath.Match(t.filter, name); err != nil || !ok {
+			return nil, false
+		}
+	}
+
+	sep := t.separator
+	if len(sep) == 0 {
+		sep = "."
+	}
+	fieldNames := strings.Split(t.pattern, ".")
+	tokens := strings.Split(name, sep)
+	if len(fieldNames) != len(tokens) {
+		return nil, false
+	}
+
+	fields := make(map[string]string, len(tokens))
+	for i, fieldName := range fieldNames {
+		fields[fieldName] = tokens[i]
+	}
+	return fields, true
+}
+
+// streamClassifier maps a point_type token (bound by a streamTemplate) to a
+// Brick class URI, loaded once from a YAML file at startup.
+type streamClassifier struct {
+	pointTypeToClass map[string]string
+}
+
+// loadStreamClassifier reads the point_type -> Brick class YAML mapping at
+// path. An empty path disables classification entirely.
+func loadStreamClassifier(path string) (*streamClassifier, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read classification mapping %s: %w", path, err)
+	}
+	var mapping map[string]string
+	if err := yaml.Unmarshal(raw, &mapping); err != nil {
+		return nil, fmt.Errorf("Could not parse classification mapping %s: %w", path, err)
+	}
+	return &streamClassifier{pointTypeToClass: mapping}, nil
+}
+
+// loadTemplates fetches source's templates from stream_templates, in the
+// order they should be tried.
+func (db *TimescaleDatabase) loadTemplates(ctx context.Context, txn pgx.Tx, source string) ([]streamTemplate, error) {
+	rows, err := txn.Query(ctx, `SELECT id, source, filter, pattern, separator
+								  FROM stream_templates WHERE source = $1 ORDER BY id`, source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var templates []streamTemplate
+	for rows.Next() {
+		var t streamTemplate
+		if err := rows.Scan(&t.id, &t.source, &t.filter, &t.pattern, &t.separator); err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// classify fills in stream.BrickClass/BrickURI (and, if a template binds a
+// "unit" field, stream.Units) from the source's stream_templates when the
+// caller didn't already supply both explicitly. It runs inside the same
+// transaction RegisterStream uses to insert the stream and its triple, so
+// the derived classification is atomic with the rest of registration. A
+// stream whose name matches no template is left exactly as the caller sent
+// it.
+func (db *TimescaleDatabase) classify(ctx context.Context, txn pgx.Tx, stream *Stream) error {
+	if db.classifier == nil || (len(stream.BrickClass) > 0 && len(stream.BrickURI) > 0) {
+		return nil
+	}
+
+	templates, err := db.loadTemplates(ctx, txn, stream.SourceName)
+	if err != nil {
+		return fmt.Errorf("Could not load stream templates for source %s: %w", stream.SourceName, err)
+	}
+
+	for _, tmpl := range templates {
+		fields, ok := tmpl.match(stream.Name)
+		if !ok {
+			continue
+		}
+		pointType, ok := fields["point_type"]
+		if !ok {
+			continue
+		}
+		class, ok := db.classifier.pointTypeToClass[pointType]
+		if !ok {
+			continue
+		}
+
+		if len(stream.BrickClass) == 0 {
+			stream.BrickClass = class
+		}
+		if len(stream.BrickURI) == 0 {
+			stream.BrickURI = fmt.Sprintf("urn:mortar:%s:%s", stream.SourceName, stream.Name)
+		}
+		// a "unit" field in the template (e.g. "equip.point_type.unit")
+		// overrides whatever units the client supplied.
+		if unit, ok := fields["unit"]; ok && len(unit) > 0 {
+			stream.Units = unit
+		}
+		return nil
+	}
+
+	// no template matched: fall back to the raw stream name, i.e. leave
+	// stream's Brick fields exactly as the client set them (possibly empty).
+	return nil
+}